@@ -5,10 +5,10 @@ import (
 	"errors"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/diegogub/lib"
+	"github.com/uutwo/gocqrs/auth"
 	"gopkg.in/gin-gonic/gin.v1"
 	"log"
 	"strconv"
-	"sync"
 	"time"
 )
 
@@ -30,7 +30,6 @@ const (
 var runningApp *App
 
 type App struct {
-	lock    sync.Mutex
 	Version string `json:"version"`
 	Name    string `json:"name"`
 	Port    string `json:"port"`
@@ -43,6 +42,37 @@ type App struct {
 	Router   *gin.Engine
 
 	Sessions Sessioner `json:"-"`
+
+	// LoginProviders and OAuthProviders hold pluggable auth backends
+	// registered through AddLoginProvider, keyed by provider name.
+	LoginProviders map[string]auth.LoginProvider `json:"-"`
+	OAuthProviders map[string]auth.OAuthProvider `json:"-"`
+
+	// MaxLoginAttempts is the number of consecutive failed /auth
+	// attempts (per username+IP) allowed before lockout.
+	MaxLoginAttempts int `json:"maxLoginAttempts"`
+	// LockoutBase is the initial lockout duration; it doubles with
+	// every additional consecutive failure.
+	LockoutBase time.Duration `json:"-"`
+	// EventRatePerMinute caps HTTPEventHandler calls per caller per
+	// minute, keyed by session jti when authenticated or client IP
+	// otherwise. Zero disables the limit.
+	EventRatePerMinute int          `json:"eventRatePerMinute"`
+	LoginAttempts      AttemptStore `json:"-"`
+	eventLimiter       *rateLimiter
+
+	// OpsCIDRs gates the /secured/* operational endpoints; only callers
+	// originating from one of these networks may reach them.
+	OpsCIDRs       []string `json:"opsCIDRs"`
+	TrustedProxies []string `json:"trustedProxies"`
+	securedCIDRs   *cidrList
+
+	// SnapshotThreshold is how many events must accumulate past the last
+	// snapshot before HandleEvent writes a new one after storing an event
+	// (only used when Store implements Snapshotter).
+	SnapshotThreshold int `json:"snapshotThreshold"`
+	aggCache          *aggregateCache
+
 	// turn off auth service check
 	AuthOff         bool   `json:"authOff"`
 	Secret          string `json:"-"`
@@ -57,11 +87,27 @@ func NewApp(store EventStore) *App {
 	app.Roles = make(map[string]Role)
 	app.Entities = make(map[string]*EntityConf)
 	app.Router = gin.New()
+	// gin's own ClientIP() trusts X-Forwarded-For/X-Real-Ip unconditionally
+	// by default; everything that keys off the caller's IP (lockout, rate
+	// limiting, SecuredBy) goes through clientIP/clientIPString instead,
+	// which only trusts XFF from an allowlisted TrustedProxies peer.
+	app.Router.ForwardedByClientIP = false
 	app.Store = store
 	// set default session validity
 	app.SessionValidity = "5m"
 	d, _ := time.ParseDuration(app.SessionValidity)
 	app.sduration = d
+
+	// default brute-force / rate-limit settings, overridable on App
+	app.MaxLoginAttempts = 5
+	app.LockoutBase = time.Second
+	app.LoginAttempts = NewMemAttemptStore(app.MaxLoginAttempts, app.LockoutBase)
+	app.EventRatePerMinute = 120
+	app.eventLimiter = newRateLimiter(app.EventRatePerMinute)
+
+	app.SnapshotThreshold = defaultSnapshotThreshold
+	app.aggCache = newAggregateCache(defaultAggregateCacheSize)
+
 	return &app
 }
 
@@ -82,8 +128,12 @@ func (app *App) Auth(s Sessioner, evh ...EventHandler) {
 		userEntity.AddEventHandler(h)
 	}
 	userEntity.AddEventHandler(UserEventHandler{})
+	userEntity.AddEventHandler(UserLockedEventHandler{})
+	userEntity.AddEventHandler(UserUnlockedEventHandler{})
 
 	app.RegisterEntity(userEntity)
+	app.registerRBACEntities()
+	app.registerExternalIdentities()
 }
 
 func (app *App) SessionTTL(d string) {
@@ -95,6 +145,17 @@ func (app *App) SessionTTL(d string) {
 	app.sduration = sd
 }
 
+// RateLimit reconfigures login lockout and event throttling. It must be
+// called instead of setting the fields directly, since both derive the
+// limiter state that backs them.
+func (app *App) RateLimit(maxAttempts int, lockoutBase time.Duration, eventRatePerMinute int) {
+	app.MaxLoginAttempts = maxAttempts
+	app.LockoutBase = lockoutBase
+	app.LoginAttempts = NewMemAttemptStore(maxAttempts, lockoutBase)
+	app.EventRatePerMinute = eventRatePerMinute
+	app.eventLimiter = newRateLimiter(eventRatePerMinute)
+}
+
 func (app *App) AddRoles(roles ...Role) {
 	for _, r := range roles {
 		app.Roles[r.Name] = r
@@ -113,22 +174,35 @@ func (app *App) RegisterEntity(e *EntityConf) *App {
 
 func (app *App) HandleEvent(entityName, id string, ev Eventer, versionLock uint64) (string, uint64, error) {
 	var err error
-	app.lock.Lock()
-	defer app.lock.Unlock()
 
 	econf, ok := app.Entities[entityName]
 	if !ok {
 		return "", 0, InvalidEntityError
 	}
 
-	// look for entity events, TODO eventstore should cache streams
 	stream := entityName + "-" + id
-	ch, _ := app.Store.Range(stream)
-	entity, err := econf.Aggregate(id, ch)
+	cached := app.aggCache.lockFor(stream)
+	cached.mu.Lock()
+	defer cached.mu.Unlock()
+
+	entity, version, baseVersion, err := app.aggregate(econf, id)
 	if err != nil {
 		return "", 0, err
 	}
 
+	// optimistic concurrency: the caller's view may be stale since the
+	// cache lock was acquired after they last read the version, so
+	// refresh once from the store before giving up.
+	if versionLock != 0 && versionLock != version {
+		entity, version, baseVersion, err = app.aggregate(econf, id)
+		if err != nil {
+			return "", 0, err
+		}
+		if versionLock != version {
+			return "", 0, errors.New("Entity version mismatch")
+		}
+	}
+
 	h, has := econf.EventHandlers[ev.GetType()]
 	if !has {
 		return "", 0, errors.New("Invalid handler for event:" + ev.GetType())
@@ -168,8 +242,19 @@ func (app *App) HandleEvent(entityName, id string, ev Eventer, versionLock uint6
 		}
 	}
 
-	version, err := app.Store.Store(ev, opt)
-	return entity.ID, version, err
+	version, err = app.Store.Store(ev, opt)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Snapshot from the state that now includes the event we just
+	// persisted, keyed off the post-write version - not the pre-write
+	// read used for the version check above.
+	if snap, ok := app.Store.(Snapshotter); ok {
+		app.maybeSnapshot(snap, stream, entity, version, baseVersion)
+	}
+
+	return entity.ID, version, nil
 }
 
 // Start app
@@ -179,6 +264,22 @@ func (app *App) Run(port string) error {
 	app.Router.GET("/entity/:entity/:id", EntityHandler)
 	app.Router.POST("/auth", AuthHandler)
 	app.Router.POST("/session/renew", AuthRenewHandler)
+	app.Router.POST("/session/logout", LogoutHandler)
+	app.Router.POST("/session/logout-all", LogoutAllHandler)
+	app.Router.GET("/auth/:provider", OAuthRedirectHandler)
+	app.Router.GET("/auth/:provider/callback", OAuthCallbackHandler)
+	app.Router.POST("/auth/:provider", ProviderLoginHandler)
+	app.Router.GET("/auth/:provider/link", OAuthLinkRedirectHandler)
+	app.Router.GET("/auth/:provider/link/callback", OAuthLinkCallbackHandler)
+	app.Router.POST("/admin/roles", AdminCreateRoleHandler)
+	app.Router.GET("/admin/roles", AdminListRolesHandler)
+	app.Router.POST("/admin/users/:id/roles", AdminAddUserRoleHandler)
+
+	secured := app.SecuredBy(app.OpsCIDRs...)
+	app.Router.POST("/secured/entity/:entity/:id/rebuild", secured, SecuredRebuildHandler)
+	app.Router.POST("/secured/entity/:entity/:id/snapshot", secured, SecuredSnapshotHandler)
+	app.Router.POST("/secured/roles/:user/add/:role", secured, SecuredAddRoleHandler)
+
 	runningApp = app
 	return runningApp.Router.Run(port)
 }
@@ -196,17 +297,24 @@ func AuthHandler(c *gin.Context) {
 	password := c.PostForm("p")
 	t := c.PostForm("t")
 
+	if checkLoginLockout(c, username) {
+		return
+	}
+
 	e, _, err := runningApp.Entity("user", username)
 	if err != nil {
+		runningApp.recordLoginFailure(username, clientIPString(runningApp, c))
 		c.JSON(401, map[string]string{"error": "Failed to login"})
 		return
 	}
 	e.Decode(&u)
 	err = u.CheckPassword(password)
 	if err != nil {
+		runningApp.recordLoginFailure(username, clientIPString(runningApp, c))
 		c.JSON(401, map[string]string{"error": "Failed to login"})
 		return
 	}
+	runningApp.recordLoginSuccess(username, clientIPString(runningApp, c))
 
 	allowedReferer := false
 	// I have to check referers to login, or ask for user token
@@ -229,28 +337,61 @@ func AuthHandler(c *gin.Context) {
 		//TODO CHECK IP
 	}
 
-	// Create token with basic user data
-	claims := SessionClaims{
-		u.Username,
-		u.Role,
-		jwt.StandardClaims{
-			IssuedAt:  time.Now().Unix(),
-			ExpiresAt: time.Now().Add(runningApp.sduration).Unix(),
-			Issuer:    runningApp.Name,
-			Id:        lib.NewShortId(""),
-		},
+	// Create access token + refresh token and persist the session
+	tokenString, refreshToken, err := runningApp.newSession(u)
+	if err != nil {
+		c.JSON(500, map[string]string{"error": "Failed to create session"})
+		return
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// Sign and get the complete encoded token as a string using the secret
-	tokenString, _ := token.SignedString([]byte(runningApp.Secret))
 
 	c.SetCookie("cs", tokenString, -1, "/", runningApp.Domain, false, true)
-	c.JSON(200, map[string]string{"auth-token": tokenString})
+	c.JSON(200, map[string]string{"auth-token": tokenString, "refresh-token": refreshToken})
 }
 
 func AuthRenewHandler(c *gin.Context) {
-	// Renew session
+	sessionID := c.PostForm("session")
+	refreshToken := c.PostForm("refresh-token")
+
+	tokenString, newRefreshToken, err := runningApp.renewSession(sessionID, refreshToken)
+	if err != nil {
+		c.JSON(401, map[string]string{"error": err.Error()})
+		return
+	}
+
+	c.SetCookie("cs", tokenString, -1, "/", runningApp.Domain, false, true)
+	c.JSON(200, map[string]string{"auth-token": tokenString, "refresh-token": newRefreshToken})
+}
+
+func LogoutHandler(c *gin.Context) {
+	claims, err := runningApp.authenticate(c)
+	if err != nil {
+		c.JSON(401, map[string]string{"error": "Failed to login"})
+		return
+	}
+
+	err = runningApp.Sessions.Revoke(claims.Id)
+	if err != nil {
+		c.JSON(400, map[string]string{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, map[string]string{"status": "logged out"})
+}
+
+func LogoutAllHandler(c *gin.Context) {
+	claims, err := runningApp.authenticate(c)
+	if err != nil {
+		c.JSON(401, map[string]string{"error": "Failed to login"})
+		return
+	}
+
+	err = runningApp.Sessions.RevokeAllByUser(claims.Username)
+	if err != nil {
+		c.JSON(400, map[string]string{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, map[string]string{"status": "logged out everywhere"})
 }
 
 func HTTPEventHandler(c *gin.Context) {
@@ -260,12 +401,25 @@ func HTTPEventHandler(c *gin.Context) {
 
 	data := make(map[string]interface{})
 
+	// get entity id
+	enID := c.Request.Header.Get(EntityHeader)
+	if enID == "" {
+		enID = lib.NewShortId("")
+	}
+
+	rateKey := clientIPString(runningApp, c)
+
 	if !runningApp.AuthOff {
-		_, err = runningApp.auth(eType, c)
-		if err != nil {
-			c.JSON(401, map[string]interface{}{"error": err.Error()})
+		claims, authErr := runningApp.auth(e, eType, enID, c)
+		if authErr != nil {
+			c.JSON(401, map[string]interface{}{"error": authErr.Error()})
 			return
 		}
+		rateKey = claims.Id
+	}
+
+	if checkEventRateLimit(c, rateKey) {
+		return
 	}
 
 	err = c.BindJSON(&data)
@@ -279,12 +433,6 @@ func HTTPEventHandler(c *gin.Context) {
 
 	// get event type
 
-	// get entity id
-	enID := c.Request.Header.Get(EntityHeader)
-	if enID == "" {
-		enID = lib.NewShortId("")
-	}
-
 	// get event id
 	eID := c.Request.Header.Get(EventIDHeader)
 
@@ -326,29 +474,15 @@ func (app *App) Entity(name, id string) (*Entity, uint64, error) {
 		return nil, 0, errors.New("Invalid entity name")
 	}
 
-	// look for entity events, TODO eventstore should cache streams
 	stream := name + "-" + id
-	ch, version := app.Store.Range(stream)
-	entity, err := econf.Aggregate(id, ch)
-	if err != nil {
-		return nil, 0, err
-	}
-	entity.Version = version
+	cached := app.aggCache.lockFor(stream)
+	cached.mu.RLock()
+	defer cached.mu.RUnlock()
 
+	entity, version, _, err := app.aggregate(econf, id)
 	return entity, version, err
 }
 
-func (app *App) authRole(eventType, role string) bool {
-	allowed := false
-	for _, r := range app.Roles {
-		if r.Name == role {
-			allowed = r.Can(eventType)
-			break
-		}
-	}
-	return allowed
-}
-
 func (app *App) CheckReference(e, k, value string, null bool) error {
 	if value == "" && null {
 		return nil
@@ -363,7 +497,12 @@ func (app *App) CheckReference(e, k, value string, null bool) error {
 	return err
 }
 
-func (app *App) auth(event string, c *gin.Context) (*SessionClaims, error) {
+// authenticate validates the caller's session token and, unless it has
+// been revoked, returns its claims. It performs no permission check, so
+// it's the right building block for endpoints that only need to know
+// who's calling (e.g. logging a session out) rather than what they're
+// allowed to do.
+func (app *App) authenticate(c *gin.Context) (*SessionClaims, error) {
 	var err error
 	t := ""
 	// Read cookie
@@ -383,14 +522,58 @@ func (app *App) auth(event string, c *gin.Context) (*SessionClaims, error) {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*SessionClaims); ok && token.Valid {
-		if !app.authRole(claims.Role, event) {
-			return nil, errors.New("Invalid Role")
-		}
+	claims, ok := token.Claims.(*SessionClaims)
+	if !ok || !token.Valid {
+		return nil, err
+	}
 
-		return claims, err
-	} else {
+	if app.Sessions != nil && app.Sessions.IsRevoked(claims.Id) {
+		return nil, errors.New("Session revoked")
+	}
+
+	return claims, err
+}
+
+// auth validates the caller's session token and checks that its user is
+// allowed to perform eventType against entity (and, when resourceID is
+// set, that specific resource).
+func (app *App) auth(entity, eventType, resourceID string, c *gin.Context) (*SessionClaims, error) {
+	claims, err := app.authenticate(c)
+	if err != nil {
 		return nil, err
 	}
 
+	if !app.authorize(claims, entity, eventType, resourceID) {
+		return nil, errors.New("Invalid Role")
+	}
+
+	return claims, nil
+}
+
+// authorize evaluates whether claims grants access to (entity, eventType,
+// resourceID). It merges the user's persisted permissions (loaded fresh
+// from the "role"/"user_role" entities on every call, so a revoked
+// binding takes effect immediately) with the static app.Roles permissions
+// for claims.Role, and applies deny-wins precedence across the combined
+// set. Evaluating both sources together - rather than granting access if
+// either independently allows it - means a persisted deny always wins
+// even when a statically configured role would otherwise still allow the
+// request, so revoking through the persisted API is actually authoritative.
+func (app *App) authorize(claims *SessionClaims, entity, eventType, resourceID string) bool {
+	perms := app.effectivePermissions(claims.Username)
+	if r, ok := app.Roles[claims.Role]; ok {
+		perms = append(perms, r.Permissions...)
+	}
+
+	allowed := false
+	for _, p := range perms {
+		if !permissionMatches(p, entity, eventType, resourceID) {
+			continue
+		}
+		if p.Deny {
+			return false
+		}
+		allowed = true
+	}
+	return allowed
 }
@@ -0,0 +1,42 @@
+// Package auth defines the provider interfaces used by gocqrs to
+// authenticate users against sources other than the built-in password
+// check, without making gocqrs depend on any particular identity backend.
+package auth
+
+import "context"
+
+// Credentials holds the username/password pair submitted to a LoginProvider.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// User is the identity returned by a provider after a successful
+// authentication. It is intentionally decoupled from any entity storage
+// so providers can be written and tested without importing gocqrs.
+type User struct {
+	// ID is the provider's stable, unique identifier for this identity
+	// (e.g. an OIDC "sub" claim or LDAP DN). gocqrs binds local accounts
+	// to (provider, ID), never to Username alone, since Username is
+	// display data the provider doesn't guarantee is unique or unforgeable.
+	ID       string
+	Username string
+	Email    string
+	Role     string
+	Claims   map[string]interface{}
+}
+
+// LoginProvider authenticates credentials against an external identity
+// source (LDAP, a legacy user store, etc).
+type LoginProvider interface {
+	AttemptLogin(ctx context.Context, creds Credentials) (User, error)
+}
+
+// OAuthProvider implements an OAuth2/OIDC authorization-code flow.
+type OAuthProvider interface {
+	// AuthURL returns the provider URL the user should be redirected to,
+	// with state embedded so the callback can be correlated back to it.
+	AuthURL(state string) string
+	// Exchange trades the callback code for the authenticated user.
+	Exchange(ctx context.Context, code string) (User, error)
+}
@@ -0,0 +1,319 @@
+package gocqrs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/diegogub/lib"
+	"github.com/uutwo/gocqrs/auth"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+const oauthStateCookie = "oauth_state"
+
+// externalIdentityEntity is the CQRS entity binding a (provider, external
+// id) pair to a local username. It's the only thing provisionExternalUser
+// trusts to decide which local account an external login maps to -
+// matching on extUser.Username alone would let any configured provider
+// (or a compromised one) claim an existing user's account just by
+// returning that user's username.
+const externalIdentityEntity = "external_identity"
+
+// ExternalIdentity records which local user a (provider, external id)
+// pair is bound to.
+type ExternalIdentity struct {
+	Provider   string `json:"provider"`
+	ExternalID string `json:"externalId"`
+	Username   string `json:"username"`
+}
+
+func externalIdentityStreamID(provider, externalID string) string {
+	return provider + ":" + externalID
+}
+
+// ExternalIdentityEventHandler applies external_identity.link events to
+// the "external_identity" entity.
+type ExternalIdentityEventHandler struct{}
+
+func (ExternalIdentityEventHandler) GetType() string { return "external_identity.link" }
+
+func (ExternalIdentityEventHandler) Handle(id string, ev Eventer, entity *Entity) (interface{}, error) {
+	e, ok := ev.(*Event)
+	if !ok {
+		return nil, errors.New("Invalid event")
+	}
+	entity.Data = e.Data
+	return nil, nil
+}
+
+// registerExternalIdentities wires up the "external_identity" CQRS entity
+// used to bind external logins to local accounts.
+func (app *App) registerExternalIdentities() {
+	identityEntity := NewEntityConf(externalIdentityEntity)
+	identityEntity.AddCRUD()
+	identityEntity.AddEventHandler(ExternalIdentityEventHandler{})
+	app.RegisterEntity(identityEntity)
+}
+
+// linkExternalIdentity binds (provider, externalID) to username, so a
+// later login from that identity resolves back to the same local
+// account regardless of what username the provider reports.
+func (app *App) linkExternalIdentity(provider, externalID, username string) error {
+	data := map[string]interface{}{
+		"provider":   provider,
+		"externalId": externalID,
+		"username":   username,
+	}
+	event := NewEvent(lib.NewShortId(""), "external_identity.link", data)
+	event.Entity = externalIdentityEntity
+	event.EntityID = externalIdentityStreamID(provider, externalID)
+
+	_, _, err := app.HandleEvent(event.Entity, event.EntityID, event, 0)
+	return err
+}
+
+// AddLoginProvider registers a password-style auth.LoginProvider or an
+// auth.OAuthProvider under name. Password providers are tried from
+// POST /auth/:name, OAuth providers drive the GET /auth/:name and
+// /auth/:name/callback redirect flow.
+func (app *App) AddLoginProvider(name string, p interface{}) {
+	switch provider := p.(type) {
+	case auth.OAuthProvider:
+		if app.OAuthProviders == nil {
+			app.OAuthProviders = make(map[string]auth.OAuthProvider)
+		}
+		app.OAuthProviders[name] = provider
+	case auth.LoginProvider:
+		if app.LoginProviders == nil {
+			app.LoginProviders = make(map[string]auth.LoginProvider)
+		}
+		app.LoginProviders[name] = provider
+	default:
+		log.Fatal("AddLoginProvider: p must implement auth.LoginProvider or auth.OAuthProvider")
+	}
+}
+
+// provisionExternalUser resolves extUser to a local account, binding it
+// to provider on first login. The join key is always the persisted
+// (provider, extUser.ID) binding, never extUser.Username: a provider's
+// username is display data it doesn't guarantee is unique, so trusting
+// it directly would let any provider log a caller into an existing
+// account just by reporting that account's username.
+func (app *App) provisionExternalUser(provider string, extUser auth.User) (User, error) {
+	var u User
+
+	if extUser.ID == "" {
+		return u, errors.New("provider did not return a stable external id")
+	}
+
+	if e, _, err := app.Entity(externalIdentityEntity, externalIdentityStreamID(provider, extUser.ID)); err == nil {
+		var link ExternalIdentity
+		e.Decode(&link)
+		ue, _, err := app.Entity("user", link.Username)
+		if err != nil {
+			return u, err
+		}
+		ue.Decode(&u)
+		return u, nil
+	}
+
+	// No binding yet for this identity. Only auto-provision a new account
+	// when extUser.Username isn't already claimed by a different local
+	// user; otherwise this identity must be linked explicitly (see
+	// OAuthLinkRedirectHandler) while signed in as that account.
+	if _, _, err := app.Entity("user", extUser.Username); err == nil {
+		return u, errors.New("an account with this username already exists; sign in and link this provider first")
+	}
+
+	data := map[string]interface{}{
+		"username": extUser.Username,
+		"email":    extUser.Email,
+		"role":     extUser.Role,
+	}
+
+	event := NewEvent(lib.NewShortId(""), "user.create", data)
+	event.Entity = "user"
+	event.EntityID = extUser.Username
+
+	_, _, err := app.HandleEvent(event.Entity, event.EntityID, event, 0)
+	if err != nil {
+		return u, err
+	}
+
+	if err := app.linkExternalIdentity(provider, extUser.ID, extUser.Username); err != nil {
+		return u, err
+	}
+
+	e, _, err := app.Entity("user", extUser.Username)
+	if err != nil {
+		return u, err
+	}
+	e.Decode(&u)
+	return u, nil
+}
+
+func OAuthRedirectHandler(c *gin.Context) {
+	name := c.Param("provider")
+	p, ok := runningApp.OAuthProviders[name]
+	if !ok {
+		c.JSON(404, map[string]string{"error": "Unknown provider"})
+		return
+	}
+
+	state := lib.NewShortId("")
+	c.SetCookie(oauthStateCookie, state, 300, "/", runningApp.Domain, false, true)
+	c.Redirect(302, p.AuthURL(state))
+}
+
+func OAuthCallbackHandler(c *gin.Context) {
+	name := c.Param("provider")
+	p, ok := runningApp.OAuthProviders[name]
+	if !ok {
+		c.JSON(404, map[string]string{"error": "Unknown provider"})
+		return
+	}
+
+	expectedState, _ := c.Cookie(oauthStateCookie)
+	if expectedState == "" || expectedState != c.Query("state") {
+		c.JSON(401, map[string]string{"error": "Invalid state"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	extUser, err := p.Exchange(ctx, c.Query("code"))
+	if err != nil {
+		c.JSON(401, map[string]string{"error": "Failed to login"})
+		return
+	}
+
+	u, err := runningApp.provisionExternalUser(name, extUser)
+	if err != nil {
+		c.JSON(500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	tokenString, refreshToken, err := runningApp.newSession(u)
+	if err != nil {
+		c.JSON(500, map[string]string{"error": "Failed to create session"})
+		return
+	}
+
+	c.SetCookie("cs", tokenString, -1, "/", runningApp.Domain, false, true)
+	c.JSON(200, map[string]string{"auth-token": tokenString, "refresh-token": refreshToken})
+}
+
+// oauthLinkUserCookie carries the identity of the already-authenticated
+// caller through an OAuthLinkRedirectHandler/OAuthLinkCallbackHandler
+// round trip, so the callback binds the identity to that caller's
+// account instead of auto-provisioning or matching on username.
+const oauthLinkUserCookie = "oauth_link_user"
+
+// OAuthLinkRedirectHandler starts an OAuth flow on behalf of the caller's
+// already-authenticated account, so the resulting identity gets bound to
+// it via OAuthLinkCallbackHandler instead of being auto-provisioned or
+// matched against an unrelated account.
+func OAuthLinkRedirectHandler(c *gin.Context) {
+	claims, err := runningApp.authenticate(c)
+	if err != nil {
+		c.JSON(401, map[string]string{"error": "Failed to login"})
+		return
+	}
+
+	name := c.Param("provider")
+	p, ok := runningApp.OAuthProviders[name]
+	if !ok {
+		c.JSON(404, map[string]string{"error": "Unknown provider"})
+		return
+	}
+
+	state := lib.NewShortId("")
+	c.SetCookie(oauthStateCookie, state, 300, "/", runningApp.Domain, false, true)
+	c.SetCookie(oauthLinkUserCookie, claims.Username, 300, "/", runningApp.Domain, false, true)
+	c.Redirect(302, p.AuthURL(state))
+}
+
+// OAuthLinkCallbackHandler completes an OAuthLinkRedirectHandler flow,
+// binding the external identity to the account that started it.
+func OAuthLinkCallbackHandler(c *gin.Context) {
+	name := c.Param("provider")
+	p, ok := runningApp.OAuthProviders[name]
+	if !ok {
+		c.JSON(404, map[string]string{"error": "Unknown provider"})
+		return
+	}
+
+	expectedState, _ := c.Cookie(oauthStateCookie)
+	linkUser, _ := c.Cookie(oauthLinkUserCookie)
+	if expectedState == "" || expectedState != c.Query("state") || linkUser == "" {
+		c.JSON(401, map[string]string{"error": "Invalid state"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	extUser, err := p.Exchange(ctx, c.Query("code"))
+	if err != nil {
+		c.JSON(401, map[string]string{"error": "Failed to login"})
+		return
+	}
+	if extUser.ID == "" {
+		c.JSON(500, map[string]string{"error": "provider did not return a stable external id"})
+		return
+	}
+
+	if err := runningApp.linkExternalIdentity(name, extUser.ID, linkUser); err != nil {
+		c.JSON(400, map[string]string{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, map[string]string{"status": "linked"})
+}
+
+func ProviderLoginHandler(c *gin.Context) {
+	name := c.Param("provider")
+	p, ok := runningApp.LoginProviders[name]
+	if !ok {
+		c.JSON(404, map[string]string{"error": "Unknown provider"})
+		return
+	}
+
+	creds := auth.Credentials{
+		Username: c.PostForm("u"),
+		Password: c.PostForm("p"),
+	}
+
+	if checkLoginLockout(c, creds.Username) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	extUser, err := p.AttemptLogin(ctx, creds)
+	if err != nil {
+		runningApp.recordLoginFailure(creds.Username, clientIPString(runningApp, c))
+		c.JSON(401, map[string]string{"error": "Failed to login"})
+		return
+	}
+	runningApp.recordLoginSuccess(creds.Username, clientIPString(runningApp, c))
+
+	u, err := runningApp.provisionExternalUser(name, extUser)
+	if err != nil {
+		c.JSON(500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	tokenString, refreshToken, err := runningApp.newSession(u)
+	if err != nil {
+		c.JSON(500, map[string]string{"error": "Failed to create session"})
+		return
+	}
+
+	c.SetCookie("cs", tokenString, -1, "/", runningApp.Domain, false, true)
+	c.JSON(200, map[string]string{"auth-token": tokenString, "refresh-token": refreshToken})
+}
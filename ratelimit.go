@@ -0,0 +1,265 @@
+package gocqrs
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/diegogub/lib"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// AttemptStore tracks consecutive failed login attempts per key (usually
+// "username|client-ip") so App can lock out an account with an
+// exponentially increasing backoff.
+type AttemptStore interface {
+	// RecordFailure registers a failed attempt for key and returns the
+	// new consecutive failure count along with the time the key is
+	// locked until (zero if not locked).
+	RecordFailure(key string) (attempts int, lockedUntil time.Time)
+	// RecordSuccess clears any failure count and lock for key, reporting
+	// whether key had ever reached a lockout (even one whose backoff has
+	// since expired), so the caller can tell a real unlock from a plain
+	// "never failed" success.
+	RecordSuccess(key string) (wasLocked bool)
+	// LockedUntil returns the time key is locked until, or the zero
+	// value if key is not currently locked.
+	LockedUntil(key string) time.Time
+}
+
+type attemptRecord struct {
+	failures    int
+	lockedUntil time.Time
+}
+
+// maxLockoutDuration caps the exponential backoff below. Without a cap, a
+// sufficiently persistent attacker eventually pushes the shift past 63
+// bits, wrapping the resulting time.Duration (an int64 count of
+// nanoseconds) into a negative value - which would put lockedUntil in the
+// past and lift the lockout instead of extending it.
+const maxLockoutDuration = 24 * time.Hour
+
+// MemAttemptStore is the default in-memory AttemptStore, backed by a
+// simple per-key counter with exponential backoff. It is safe for
+// concurrent use.
+type MemAttemptStore struct {
+	mu          sync.Mutex
+	records     map[string]*attemptRecord
+	base        time.Duration
+	maxAttempts int
+}
+
+func NewMemAttemptStore(maxAttempts int, base time.Duration) *MemAttemptStore {
+	return &MemAttemptStore{
+		records:     make(map[string]*attemptRecord),
+		base:        base,
+		maxAttempts: maxAttempts,
+	}
+}
+
+func (s *MemAttemptStore) RecordFailure(key string) (int, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.records[key]
+	if !ok {
+		r = &attemptRecord{}
+		s.records[key] = r
+	}
+	r.failures++
+
+	// Only lock out once failures reach maxAttempts; below that, the
+	// caller just gets a higher failure count back and no lockedUntil.
+	if r.failures < s.maxAttempts {
+		return r.failures, time.Time{}
+	}
+
+	shift := uint(r.failures - s.maxAttempts)
+	if shift > 62 {
+		shift = 62
+	}
+	backoff := s.base << shift
+	if backoff <= 0 || backoff > maxLockoutDuration {
+		backoff = maxLockoutDuration
+	}
+	r.lockedUntil = time.Now().Add(backoff)
+
+	return r.failures, r.lockedUntil
+}
+
+func (s *MemAttemptStore) RecordSuccess(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.records[key]
+	wasLocked := ok && !r.lockedUntil.IsZero()
+	delete(s.records, key)
+	return wasLocked
+}
+
+func (s *MemAttemptStore) LockedUntil(key string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.records[key]
+	if !ok {
+		return time.Time{}
+	}
+	return r.lockedUntil
+}
+
+// rateLimiter is a fixed-window counter keyed by caller identity, used to
+// throttle calls to HTTPEventHandler.
+type rateLimiter struct {
+	mu        sync.Mutex
+	perMinute int
+	window    map[string]*rateWindow
+}
+
+type rateWindow struct {
+	count     int
+	windowEnd time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{perMinute: perMinute, window: make(map[string]*rateWindow)}
+}
+
+func (rl *rateLimiter) Allow(key string) bool {
+	if rl.perMinute <= 0 {
+		return true
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	w, ok := rl.window[key]
+	if !ok || now.After(w.windowEnd) {
+		w = &rateWindow{count: 0, windowEnd: now.Add(time.Minute)}
+		rl.window[key] = w
+	}
+
+	w.count++
+	return w.count <= rl.perMinute
+}
+
+// loginAttemptKey identifies a login attempt for lockout purposes.
+func loginAttemptKey(username, ip string) string {
+	return username + "|" + ip
+}
+
+// recordLoginFailure bumps the failure count for username/ip and, every
+// time that leaves it locked out, emits an auditable user.locked event.
+// It's ">=" rather than "==" because a caller that keeps failing after a
+// lockout expires re-locks with a longer backoff on every attempt
+// (attempts = maxAttempts, maxAttempts+1, ...), and each of those needs
+// its own event or the persisted lockedUntil goes stale after the first.
+func (app *App) recordLoginFailure(username, ip string) time.Time {
+	attempts, lockedUntil := app.LoginAttempts.RecordFailure(loginAttemptKey(username, ip))
+	if attempts >= app.MaxLoginAttempts {
+		app.emitUserLockEvent(username, "user.locked", lockedUntil)
+	}
+	return lockedUntil
+}
+
+// recordLoginSuccess clears the failure count for username/ip, emitting
+// user.unlocked if the account had ever reached a lockout. It relies on
+// RecordSuccess's own wasLocked report rather than comparing LockedUntil
+// against time.Now: by the time a login can succeed, checkLoginLockout
+// has already rejected every attempt while the lock was still active, so
+// LockedUntil is always zero or already in the past here.
+func (app *App) recordLoginSuccess(username, ip string) {
+	key := loginAttemptKey(username, ip)
+	wasLocked := app.LoginAttempts.RecordSuccess(key)
+	if wasLocked {
+		app.emitUserLockEvent(username, "user.unlocked", time.Time{})
+	}
+}
+
+func (app *App) emitUserLockEvent(username, eventType string, lockedUntil time.Time) {
+	data := map[string]interface{}{
+		"username": username,
+	}
+	if !lockedUntil.IsZero() {
+		data["lockedUntil"] = lockedUntil.Unix()
+	}
+
+	event := NewEvent(lib.NewShortId(""), eventType, data)
+	event.Entity = "user"
+	event.EntityID = username
+
+	if _, _, err := app.HandleEvent(event.Entity, event.EntityID, event, 0); err != nil {
+		log.Println("emitUserLockEvent:", eventType, username, err)
+	}
+}
+
+// UserLockedEventHandler applies user.locked events to the "user" entity,
+// recording that the account is locked out and, when present, until when.
+type UserLockedEventHandler struct{}
+
+func (UserLockedEventHandler) GetType() string { return "user.locked" }
+
+func (UserLockedEventHandler) Handle(id string, ev Eventer, entity *Entity) (interface{}, error) {
+	e, ok := ev.(*Event)
+	if !ok {
+		return nil, errors.New("Invalid event")
+	}
+
+	if entity.Data == nil {
+		entity.Data = map[string]interface{}{}
+	}
+	entity.Data["locked"] = true
+	if lockedUntil, ok := e.Data["lockedUntil"]; ok {
+		entity.Data["lockedUntil"] = lockedUntil
+	}
+
+	return nil, nil
+}
+
+// UserUnlockedEventHandler applies user.unlocked events to the "user"
+// entity, clearing a prior lockout.
+type UserUnlockedEventHandler struct{}
+
+func (UserUnlockedEventHandler) GetType() string { return "user.unlocked" }
+
+func (UserUnlockedEventHandler) Handle(id string, ev Eventer, entity *Entity) (interface{}, error) {
+	if entity.Data == nil {
+		entity.Data = map[string]interface{}{}
+	}
+	entity.Data["locked"] = false
+	delete(entity.Data, "lockedUntil")
+
+	return nil, nil
+}
+
+// checkLoginLockout returns a 429 with Retry-After and true if username/ip
+// is currently locked out.
+func checkLoginLockout(c *gin.Context, username string) bool {
+	ip := clientIPString(runningApp, c)
+	lockedUntil := runningApp.LoginAttempts.LockedUntil(loginAttemptKey(username, ip))
+	if lockedUntil.IsZero() || time.Now().After(lockedUntil) {
+		return false
+	}
+
+	retryAfter := int(time.Until(lockedUntil).Seconds())
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(429, map[string]string{"error": "Too many failed attempts, try again later"})
+	return true
+}
+
+// checkEventRateLimit throttles access to HTTPEventHandler, keyed by
+// session jti when available or client IP otherwise.
+func checkEventRateLimit(c *gin.Context, key string) bool {
+	if runningApp.eventLimiter == nil || runningApp.eventLimiter.Allow(key) {
+		return false
+	}
+
+	c.JSON(429, map[string]string{"error": "Rate limit exceeded"})
+	return true
+}
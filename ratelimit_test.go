@@ -0,0 +1,152 @@
+package gocqrs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemAttemptStore_NoLockoutBelowMaxAttempts(t *testing.T) {
+	store := NewMemAttemptStore(3, time.Second)
+
+	for attempt := 1; attempt < 3; attempt++ {
+		attempts, lockedUntil := store.RecordFailure("bob|1.2.3.4")
+		if attempts != attempt {
+			t.Fatalf("attempt %d: expected failure count %d, got %d", attempt, attempt, attempts)
+		}
+		if !lockedUntil.IsZero() {
+			t.Fatalf("attempt %d: expected no lockout before reaching maxAttempts, got %v", attempt, lockedUntil)
+		}
+	}
+}
+
+func TestMemAttemptStore_ExponentialBackoffOnceMaxAttemptsReached(t *testing.T) {
+	store := NewMemAttemptStore(3, time.Second)
+
+	cases := []struct {
+		attempt      int
+		wantDuration time.Duration
+	}{
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{6, 8 * time.Second},
+	}
+
+	for i := 0; i < 2; i++ {
+		store.RecordFailure("bob|1.2.3.4")
+	}
+
+	for _, c := range cases {
+		before := time.Now()
+		attempts, lockedUntil := store.RecordFailure("bob|1.2.3.4")
+		if attempts != c.attempt {
+			t.Fatalf("attempt %d: expected failure count %d, got %d", c.attempt, c.attempt, attempts)
+		}
+		got := lockedUntil.Sub(before)
+		if got < c.wantDuration || got > c.wantDuration+100*time.Millisecond {
+			t.Fatalf("attempt %d: expected lockout around %v, got %v", c.attempt, c.wantDuration, got)
+		}
+	}
+}
+
+func TestMemAttemptStore_HighFailureCountClampsToMaxLockout(t *testing.T) {
+	store := NewMemAttemptStore(3, time.Second)
+
+	var lockedUntil time.Time
+	before := time.Now()
+	for i := 0; i < 100; i++ {
+		_, lockedUntil = store.RecordFailure("bob|1.2.3.4")
+	}
+
+	if lockedUntil.Before(before) {
+		t.Fatalf("expected lockedUntil to stay in the future after 100 failures, got %v", lockedUntil)
+	}
+
+	got := lockedUntil.Sub(before)
+	if got > maxLockoutDuration+100*time.Millisecond {
+		t.Fatalf("expected lockout clamped to around %v, got %v", maxLockoutDuration, got)
+	}
+	if got < maxLockoutDuration-100*time.Millisecond {
+		t.Fatalf("expected lockout near the max of %v, got %v", maxLockoutDuration, got)
+	}
+}
+
+func TestMemAttemptStore_SuccessClearsLockout(t *testing.T) {
+	store := NewMemAttemptStore(2, time.Second)
+	store.RecordFailure("bob|1.2.3.4")
+	store.RecordFailure("bob|1.2.3.4")
+
+	wasLocked := store.RecordSuccess("bob|1.2.3.4")
+	if !wasLocked {
+		t.Fatalf("expected RecordSuccess to report the prior lockout")
+	}
+
+	if locked := store.LockedUntil("bob|1.2.3.4"); !locked.IsZero() {
+		t.Fatalf("expected lockout to be cleared after a success, got %v", locked)
+	}
+}
+
+func TestMemAttemptStore_SuccessBelowMaxAttemptsIsNotReportedAsLocked(t *testing.T) {
+	store := NewMemAttemptStore(3, time.Second)
+	store.RecordFailure("bob|1.2.3.4")
+
+	if wasLocked := store.RecordSuccess("bob|1.2.3.4"); wasLocked {
+		t.Fatalf("expected RecordSuccess to report no prior lockout below maxAttempts")
+	}
+}
+
+// TestApp_RecordLoginFailureAndSuccessEmitAuditableLockEvents exercises
+// App.recordLoginFailure/recordLoginSuccess end-to-end (not just the
+// underlying MemAttemptStore), covering both bugs this test was added to
+// catch: a lockout that expires and then re-triggers must emit a fresh
+// user.locked rather than going stale, and a later success must still
+// emit user.unlocked even though checkLoginLockout guarantees
+// LockedUntil is never still in the future by the time it's called.
+func TestApp_RecordLoginFailureAndSuccessEmitAuditableLockEvents(t *testing.T) {
+	app := NewApp(newFakeEventStore())
+	app.Auth(NewMemSessionStore())
+	app.MaxLoginAttempts = 2
+	app.LoginAttempts = NewMemAttemptStore(app.MaxLoginAttempts, time.Millisecond)
+
+	create := NewEvent("ev-user-create", "user.create", map[string]interface{}{"username": "bob"})
+	create.Entity = "user"
+	create.EntityID = "bob"
+	if _, _, err := app.HandleEvent(create.Entity, create.EntityID, create, 0); err != nil {
+		t.Fatalf("user.create: %v", err)
+	}
+
+	app.recordLoginFailure("bob", "1.2.3.4") // attempts=1, below max: no lock yet
+	app.recordLoginFailure("bob", "1.2.3.4") // attempts=2 == max: locks
+
+	e, lockedVersion, err := app.Entity("user", "bob")
+	if err != nil {
+		t.Fatalf("Entity: %v", err)
+	}
+	if locked, _ := e.Data["locked"].(bool); !locked {
+		t.Fatalf("expected user.locked once MaxLoginAttempts is reached")
+	}
+
+	time.Sleep(5 * time.Millisecond) // let the 1ms backoff expire
+
+	app.recordLoginFailure("bob", "1.2.3.4") // attempts=3, still >= max: must re-lock, not go stale
+	var relockedVersion uint64
+	e, relockedVersion, err = app.Entity("user", "bob")
+	if err != nil {
+		t.Fatalf("Entity: %v", err)
+	}
+	if relockedVersion != lockedVersion+1 {
+		t.Fatalf("expected the re-lock to emit a fresh user.locked event, got version %d after %d", relockedVersion, lockedVersion)
+	}
+	if lockedUntil, ok := e.Data["lockedUntil"].(int64); !ok || lockedUntil == 0 {
+		t.Fatalf("expected a fresh lockedUntil after the prior backoff expired, got %v", e.Data["lockedUntil"])
+	}
+
+	app.recordLoginSuccess("bob", "1.2.3.4")
+	e, _, err = app.Entity("user", "bob")
+	if err != nil {
+		t.Fatalf("Entity: %v", err)
+	}
+	if locked, _ := e.Data["locked"].(bool); locked {
+		t.Fatalf("expected a successful login to emit user.unlocked and clear the lockout")
+	}
+}
@@ -0,0 +1,319 @@
+package gocqrs
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/diegogub/lib"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// AdminEntity is the pseudo-entity used to gate the role/permission admin
+// endpoints, so they can be controlled through the same ACL mechanism as
+// any other entity.
+const AdminEntity = "system"
+
+// Permission is a single allow/deny rule scoped to an entity, event type,
+// and optionally a specific resource id. Deny rules win over allow rules
+// when both match a request, so a narrow deny can carve an exception out
+// of a broader allow.
+type Permission struct {
+	Entity     string `json:"entity"`
+	EventType  string `json:"eventType"`
+	ResourceID string `json:"resourceId,omitempty"` // "" or "*" matches any resource
+	Deny       bool   `json:"deny"`
+}
+
+// Role is a named, persisted set of permissions.
+type Role struct {
+	Name        string       `json:"name"`
+	Permissions []Permission `json:"permissions"`
+}
+
+func permissionMatches(p Permission, entity, eventType, resourceID string) bool {
+	if p.Entity != "" && p.Entity != "*" && p.Entity != entity {
+		return false
+	}
+	if p.EventType != "" && p.EventType != "*" && p.EventType != eventType {
+		return false
+	}
+	if p.ResourceID != "" && p.ResourceID != "*" && p.ResourceID != resourceID {
+		return false
+	}
+	return true
+}
+
+// Can evaluates r's permissions against (entity, eventType, resourceID)
+// with deny-wins precedence.
+func (r Role) Can(entity, eventType, resourceID string) bool {
+	allowed := false
+	for _, p := range r.Permissions {
+		if !permissionMatches(p, entity, eventType, resourceID) {
+			continue
+		}
+		if p.Deny {
+			return false
+		}
+		allowed = true
+	}
+	return allowed
+}
+
+// UserRole binds a user to the set of roles it holds.
+type UserRole struct {
+	User  string   `json:"user"`
+	Roles []string `json:"roles"`
+}
+
+// RoleIndex tracks every role name that has ever been created, so the
+// admin listing endpoint can enumerate roles without the event store
+// needing to support listing all streams for an entity.
+type RoleIndex struct {
+	Names []string `json:"names"`
+}
+
+// roleIndexStreamID is the fixed id of the singleton "role_index" entity.
+const roleIndexStreamID = "index"
+
+// RoleEventHandler applies role.create events to the "role" entity.
+type RoleEventHandler struct{}
+
+func (RoleEventHandler) GetType() string { return "role.create" }
+
+func (RoleEventHandler) Handle(id string, ev Eventer, entity *Entity) (interface{}, error) {
+	e, ok := ev.(*Event)
+	if !ok {
+		return nil, errors.New("Invalid event")
+	}
+	entity.Data = e.Data
+	return nil, nil
+}
+
+// UserRoleEventHandler applies user_role.add events to the "user_role"
+// entity, appending the role if it isn't already bound.
+type UserRoleEventHandler struct{}
+
+func (UserRoleEventHandler) GetType() string { return "user_role.add" }
+
+func (UserRoleEventHandler) Handle(id string, ev Eventer, entity *Entity) (interface{}, error) {
+	e, ok := ev.(*Event)
+	if !ok {
+		return nil, errors.New("Invalid event")
+	}
+
+	role, _ := e.Data["role"].(string)
+	if role == "" {
+		return nil, errors.New("Missing role")
+	}
+
+	var ur UserRole
+	entity.Decode(&ur)
+	ur.User = id
+	if !containsString(ur.Roles, role) {
+		ur.Roles = append(ur.Roles, role)
+	}
+
+	data, err := toEntityData(ur)
+	if err != nil {
+		return nil, err
+	}
+	entity.Data = data
+
+	return nil, nil
+}
+
+// RoleIndexEventHandler applies role_index.add events to the singleton
+// "role_index" entity used to enumerate known roles.
+type RoleIndexEventHandler struct{}
+
+func (RoleIndexEventHandler) GetType() string { return "role_index.add" }
+
+func (RoleIndexEventHandler) Handle(id string, ev Eventer, entity *Entity) (interface{}, error) {
+	e, ok := ev.(*Event)
+	if !ok {
+		return nil, errors.New("Invalid event")
+	}
+
+	name, _ := e.Data["name"].(string)
+	if name == "" {
+		return nil, errors.New("Missing role name")
+	}
+
+	var idx RoleIndex
+	entity.Decode(&idx)
+	if !containsString(idx.Names, name) {
+		idx.Names = append(idx.Names, name)
+	}
+
+	data, err := toEntityData(idx)
+	if err != nil {
+		return nil, err
+	}
+	entity.Data = data
+
+	return nil, nil
+}
+
+func containsString(values []string, v string) bool {
+	for _, existing := range values {
+		if existing == v {
+			return true
+		}
+	}
+	return false
+}
+
+func toEntityData(v interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// registerRBACEntities wires up the "role", "user_role" and "role_index"
+// CQRS entities used by the admin role/permission endpoints.
+func (app *App) registerRBACEntities() {
+	roleEntity := NewEntityConf("role")
+	roleEntity.AddCRUD()
+	roleEntity.AddEventHandler(RoleEventHandler{})
+	app.RegisterEntity(roleEntity)
+
+	userRoleEntity := NewEntityConf("user_role")
+	userRoleEntity.AddCRUD()
+	userRoleEntity.AddEventHandler(UserRoleEventHandler{})
+	app.RegisterEntity(userRoleEntity)
+
+	roleIndexEntity := NewEntityConf("role_index")
+	roleIndexEntity.AddCRUD()
+	roleIndexEntity.AddEventHandler(RoleIndexEventHandler{})
+	app.RegisterEntity(roleIndexEntity)
+}
+
+// effectivePermissions returns the union of permissions across every role
+// bound to user, loaded fresh from the store so role or binding changes
+// take effect immediately rather than waiting for the JWT to expire.
+func (app *App) effectivePermissions(user string) []Permission {
+	e, _, err := app.Entity("user_role", user)
+	if err != nil {
+		return nil
+	}
+
+	var ur UserRole
+	e.Decode(&ur)
+
+	var perms []Permission
+	for _, roleName := range ur.Roles {
+		re, _, err := app.Entity("role", roleName)
+		if err != nil {
+			continue
+		}
+		var r Role
+		re.Decode(&r)
+		perms = append(perms, r.Permissions...)
+	}
+	return perms
+}
+
+func AdminCreateRoleHandler(c *gin.Context) {
+	_, err := runningApp.auth(AdminEntity, "roles.manage", "", c)
+	if err != nil {
+		c.JSON(401, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var r Role
+	if err := c.BindJSON(&r); err != nil {
+		c.JSON(400, map[string]string{"error": err.Error()})
+		return
+	}
+	if r.Name == "" {
+		c.JSON(400, map[string]string{"error": "role name is required"})
+		return
+	}
+
+	data := map[string]interface{}{
+		"name":        r.Name,
+		"permissions": r.Permissions,
+	}
+	event := NewEvent(lib.NewShortId(""), "role.create", data)
+	event.Entity = "role"
+	event.EntityID = r.Name
+
+	_, _, err = runningApp.HandleEvent(event.Entity, event.EntityID, event, 0)
+	if err != nil {
+		c.JSON(400, map[string]string{"error": err.Error()})
+		return
+	}
+
+	indexEvent := NewEvent(lib.NewShortId(""), "role_index.add", map[string]interface{}{"name": r.Name})
+	indexEvent.Entity = "role_index"
+	indexEvent.EntityID = roleIndexStreamID
+	if _, _, err = runningApp.HandleEvent(indexEvent.Entity, indexEvent.EntityID, indexEvent, 0); err != nil {
+		c.JSON(400, map[string]string{"error": err.Error()})
+		return
+	}
+
+	c.JSON(201, r)
+}
+
+func AdminListRolesHandler(c *gin.Context) {
+	_, err := runningApp.auth(AdminEntity, "roles.manage", "", c)
+	if err != nil {
+		c.JSON(401, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var idx RoleIndex
+	if e, _, err := runningApp.Entity("role_index", roleIndexStreamID); err == nil {
+		e.Decode(&idx)
+	}
+
+	roles := make([]Role, 0, len(idx.Names))
+	for _, name := range idx.Names {
+		e, _, err := runningApp.Entity("role", name)
+		if err != nil {
+			continue
+		}
+		var r Role
+		e.Decode(&r)
+		roles = append(roles, r)
+	}
+
+	c.JSON(200, roles)
+}
+
+func AdminAddUserRoleHandler(c *gin.Context) {
+	_, err := runningApp.auth(AdminEntity, "users.manage", "", c)
+	if err != nil {
+		c.JSON(401, map[string]string{"error": err.Error()})
+		return
+	}
+
+	user := c.Param("id")
+	role := c.PostForm("role")
+	if role == "" {
+		c.JSON(400, map[string]string{"error": "role is required"})
+		return
+	}
+
+	data := map[string]interface{}{
+		"user": user,
+		"role": role,
+	}
+	event := NewEvent(lib.NewShortId(""), "user_role.add", data)
+	event.Entity = "user_role"
+	event.EntityID = user
+
+	_, _, err = runningApp.HandleEvent(event.Entity, event.EntityID, event, 0)
+	if err != nil {
+		c.JSON(400, map[string]string{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, map[string]string{"status": "role added"})
+}
@@ -0,0 +1,132 @@
+package gocqrs
+
+import (
+	"sync"
+	"testing"
+)
+
+// fakeEventStore is a minimal in-memory EventStore for exercising the
+// role/permission plumbing end-to-end without a real backing store.
+type fakeEventStore struct {
+	mu     sync.Mutex
+	events map[string][]Eventer
+}
+
+func newFakeEventStore() *fakeEventStore {
+	return &fakeEventStore{events: make(map[string][]Eventer)}
+}
+
+func (s *fakeEventStore) Range(stream string) (chan Eventer, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := s.events[stream]
+	ch := make(chan Eventer, len(events))
+	for _, ev := range events {
+		ch <- ev
+	}
+	close(ch)
+	return ch, uint64(len(events))
+}
+
+func (s *fakeEventStore) Store(ev Eventer, opt interface{}) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := ev.(*Event)
+	stream := e.Entity + "-" + e.EntityID
+	s.events[stream] = append(s.events[stream], ev)
+	return uint64(len(s.events[stream])), nil
+}
+
+func (s *fakeEventStore) Version(stream string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return uint64(len(s.events[stream])), nil
+}
+
+func TestRoleCan_DenyWinsOverAllow(t *testing.T) {
+	r := Role{
+		Name: "editor",
+		Permissions: []Permission{
+			{Entity: "*", EventType: "*"},
+			{Entity: "article", EventType: "article.delete", Deny: true},
+		},
+	}
+
+	if !r.Can("article", "article.create", "") {
+		t.Fatalf("expected wildcard allow to grant article.create")
+	}
+	if r.Can("article", "article.delete", "") {
+		t.Fatalf("expected explicit deny to win over the wildcard allow")
+	}
+}
+
+func TestRoleCan_ResourceScopedDeny(t *testing.T) {
+	r := Role{
+		Name: "support",
+		Permissions: []Permission{
+			{Entity: "ticket", EventType: "*"},
+			{Entity: "ticket", EventType: "*", ResourceID: "locked-1", Deny: true},
+		},
+	}
+
+	if !r.Can("ticket", "ticket.update", "other") {
+		t.Fatalf("expected unscoped ticket to be allowed")
+	}
+	if r.Can("ticket", "ticket.update", "locked-1") {
+		t.Fatalf("expected the resource-scoped deny to win for locked-1")
+	}
+}
+
+func TestRoleCan_NoMatchIsNotAllowed(t *testing.T) {
+	r := Role{Name: "viewer", Permissions: []Permission{{Entity: "article", EventType: "article.read"}}}
+	if r.Can("article", "article.delete", "") {
+		t.Fatalf("expected no matching permission to deny by default")
+	}
+}
+
+// TestAuthorize_PersistedDenyBeatsStaticRoleAllow is a regression test for
+// b634d3b: App.authorize used to grant access if either the persisted
+// role bindings OR the static app.Roles config allowed it, so a deny
+// persisted through the admin API couldn't revoke access already granted
+// by a statically configured role. It must merge both sources and apply
+// deny-wins across the combination instead.
+func TestAuthorize_PersistedDenyBeatsStaticRoleAllow(t *testing.T) {
+	app := NewApp(newFakeEventStore())
+	app.Auth(NewMemSessionStore())
+	app.AddRoles(Role{
+		Name:        "admin",
+		Permissions: []Permission{{Entity: "*", EventType: "*"}},
+	})
+
+	createRole := NewEvent("ev-role-create", "role.create", map[string]interface{}{
+		"name": "revoke-article-delete",
+		"permissions": []Permission{
+			{Entity: "article", EventType: "article.delete", Deny: true},
+		},
+	})
+	createRole.Entity = "role"
+	createRole.EntityID = "revoke-article-delete"
+	if _, _, err := app.HandleEvent(createRole.Entity, createRole.EntityID, createRole, 0); err != nil {
+		t.Fatalf("role.create: %v", err)
+	}
+
+	bind := NewEvent("ev-user-role-add", "user_role.add", map[string]interface{}{
+		"role": "revoke-article-delete",
+	})
+	bind.Entity = "user_role"
+	bind.EntityID = "alice"
+	if _, _, err := app.HandleEvent(bind.Entity, bind.EntityID, bind, 0); err != nil {
+		t.Fatalf("user_role.add: %v", err)
+	}
+
+	claims := &SessionClaims{Username: "alice", Role: "admin"}
+
+	if app.authorize(claims, "article", "article.delete", "") {
+		t.Fatalf("expected the persisted deny to win over the static admin role's wildcard allow")
+	}
+	if !app.authorize(claims, "article", "article.create", "") {
+		t.Fatalf("expected the static admin role to still allow an unrelated action")
+	}
+}
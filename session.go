@@ -0,0 +1,228 @@
+package gocqrs
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/diegogub/lib"
+)
+
+var (
+	InvalidSessionError = errors.New("Invalid session")
+	ReplayedTokenError  = errors.New("Refresh token reuse detected")
+)
+
+// Session represents a single login session tracked server side so that
+// access tokens can be revoked before their JWT expiry.
+type Session struct {
+	ID           string `json:"id"`
+	User         string `json:"user"`
+	Role         string `json:"role"`
+	RefreshToken string `json:"-"`
+	IssuedAt     int64  `json:"issuedAt"`
+	ExpiresAt    int64  `json:"expiresAt"`
+	Revoked      bool   `json:"revoked"`
+}
+
+// Sessioner stores active sessions so App can rotate refresh tokens and
+// revoke access by session id (jti) without waiting for JWT expiry.
+type Sessioner interface {
+	Create(s Session) error
+	Get(id string) (Session, error)
+	GetByRefreshToken(token string) (Session, error)
+	// Rotate atomically replaces oldRefreshToken with newRefreshToken,
+	// failing with ReplayedTokenError if the session's current refresh
+	// token doesn't match oldRefreshToken. The check-and-swap must happen
+	// under a single lock so two concurrent renewals of the same token
+	// can't both succeed.
+	Rotate(id, oldRefreshToken, newRefreshToken string, newExpiresAt int64) error
+	Revoke(id string) error
+	RevokeAllByUser(user string) error
+	IsRevoked(id string) bool
+}
+
+// MemSessionStore is the default in-memory Sessioner implementation.
+// It is safe for concurrent use.
+type MemSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func NewMemSessionStore() *MemSessionStore {
+	return &MemSessionStore{sessions: make(map[string]Session)}
+}
+
+func (s *MemSessionStore) Create(sess Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[sess.ID] = sess
+	return nil
+}
+
+func (s *MemSessionStore) Get(id string) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return Session{}, InvalidSessionError
+	}
+	return sess, nil
+}
+
+func (s *MemSessionStore) GetByRefreshToken(token string) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.sessions {
+		if sess.RefreshToken == token {
+			return sess, nil
+		}
+	}
+	return Session{}, InvalidSessionError
+}
+
+func (s *MemSessionStore) Rotate(id, oldRefreshToken, newRefreshToken string, newExpiresAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return InvalidSessionError
+	}
+	if sess.Revoked || sess.RefreshToken != oldRefreshToken {
+		sess.Revoked = true
+		s.sessions[id] = sess
+		return ReplayedTokenError
+	}
+	sess.RefreshToken = newRefreshToken
+	sess.ExpiresAt = newExpiresAt
+	s.sessions[id] = sess
+	return nil
+}
+
+func (s *MemSessionStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return InvalidSessionError
+	}
+	sess.Revoked = true
+	s.sessions[id] = sess
+	return nil
+}
+
+func (s *MemSessionStore) RevokeAllByUser(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		if sess.User == user {
+			sess.Revoked = true
+			s.sessions[id] = sess
+		}
+	}
+	return nil
+}
+
+func (s *MemSessionStore) IsRevoked(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		// unknown session ids are treated as revoked
+		return true
+	}
+	return sess.Revoked
+}
+
+// defaultRefreshValidity controls how long an opaque refresh token stays usable.
+const defaultRefreshValidity = 720 * time.Hour
+
+// newSession issues an access JWT and opaque refresh token for u and
+// persists the session so it can later be rotated or revoked.
+func (app *App) newSession(u User) (token string, refreshToken string, err error) {
+	jti := lib.NewShortId("")
+	now := time.Now()
+
+	claims := SessionClaims{
+		u.Username,
+		u.Role,
+		jwt.StandardClaims{
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(app.sduration).Unix(),
+			Issuer:    app.Name,
+			Id:        jti,
+		},
+	}
+
+	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token, err = t.SignedString([]byte(app.Secret))
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshToken = lib.NewShortId("") + lib.NewShortId("")
+	sess := Session{
+		ID:           jti,
+		User:         u.Username,
+		Role:         u.Role,
+		RefreshToken: refreshToken,
+		IssuedAt:     now.Unix(),
+		ExpiresAt:    now.Add(defaultRefreshValidity).Unix(),
+	}
+
+	err = app.Sessions.Create(sess)
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, refreshToken, nil
+}
+
+// renewSession rotates the refresh token tied to the given session id and
+// issues a fresh access JWT. The rotation itself is a compare-and-swap on
+// refreshToken performed inside Sessioner.Rotate, so two concurrent calls
+// racing on the same (still-valid) token can't both succeed: the loser's
+// swap fails, the session is revoked, and the call is treated as a replay.
+func (app *App) renewSession(sessionID, refreshToken string) (token string, newRefreshToken string, err error) {
+	sess, err := app.Sessions.Get(sessionID)
+	if err != nil {
+		return "", "", err
+	}
+
+	if sess.Revoked || sess.RefreshToken != refreshToken {
+		app.Sessions.Revoke(sessionID)
+		return "", "", ReplayedTokenError
+	}
+
+	if time.Now().Unix() > sess.ExpiresAt {
+		app.Sessions.Revoke(sessionID)
+		return "", "", InvalidSessionError
+	}
+
+	now := time.Now()
+	claims := SessionClaims{
+		sess.User,
+		sess.Role,
+		jwt.StandardClaims{
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(app.sduration).Unix(),
+			Issuer:    app.Name,
+			Id:        sessionID,
+		},
+	}
+
+	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token, err = t.SignedString([]byte(app.Secret))
+	if err != nil {
+		return "", "", err
+	}
+
+	newRefreshToken = lib.NewShortId("") + lib.NewShortId("")
+	err = app.Sessions.Rotate(sessionID, refreshToken, newRefreshToken, now.Add(defaultRefreshValidity).Unix())
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, newRefreshToken, nil
+}
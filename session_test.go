@@ -0,0 +1,71 @@
+package gocqrs
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestMemSessionStore_RotateCAS(t *testing.T) {
+	store := NewMemSessionStore()
+	sess := Session{ID: "s1", User: "alice", RefreshToken: "rt0", ExpiresAt: 1}
+	if err := store.Create(sess); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if err := store.Rotate("s1", "wrong-token", "rt1", 2); err == nil {
+		t.Fatalf("Rotate with mismatched old token should fail")
+	}
+	if got, _ := store.Get("s1"); !got.Revoked {
+		t.Fatalf("a failed rotation should revoke the session")
+	}
+}
+
+func TestMemSessionStore_RotateConcurrentReplayOnlyOneWins(t *testing.T) {
+	store := NewMemSessionStore()
+	sess := Session{ID: "s1", User: "alice", RefreshToken: "rt0", ExpiresAt: 1}
+	if err := store.Create(sess); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	const n = 20
+	var wg sync.WaitGroup
+	successes := make([]bool, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := store.Rotate("s1", "rt0", "rt-new", 2)
+			successes[i] = err == nil
+		}(i)
+	}
+	wg.Wait()
+
+	wins := 0
+	for _, ok := range successes {
+		if ok {
+			wins++
+		}
+	}
+	if wins != 1 {
+		t.Fatalf("expected exactly one concurrent rotation to win, got %d", wins)
+	}
+}
+
+func TestMemSessionStore_RotateSucceedsWithMatchingToken(t *testing.T) {
+	store := NewMemSessionStore()
+	sess := Session{ID: "s1", User: "alice", RefreshToken: "rt0", ExpiresAt: 1}
+	if err := store.Create(sess); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if err := store.Rotate("s1", "rt0", "rt1", 2); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	got, err := store.Get("s1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.RefreshToken != "rt1" || got.ExpiresAt != 2 || got.Revoked {
+		t.Fatalf("unexpected session after rotation: %+v", got)
+	}
+}
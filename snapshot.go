@@ -0,0 +1,225 @@
+package gocqrs
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+)
+
+// Snapshotter is implemented by EventStore backends that can persist an
+// aggregate's materialized state, so Aggregate doesn't have to replay the
+// full event stream on every read.
+type Snapshotter interface {
+	SaveSnapshot(stream string, version uint64, state []byte) error
+	LoadSnapshot(stream string) (state []byte, version uint64, err error)
+}
+
+// RangeFromer is implemented by EventStore backends that can range over a
+// stream starting after a given version, so a loaded snapshot only costs
+// the events folded into it plus whatever came after - not a full replay.
+// Stores that only implement Snapshotter still work, they just fall back
+// to a full Range on every read.
+type RangeFromer interface {
+	RangeFrom(stream string, fromVersion uint64) (chan Eventer, uint64)
+}
+
+const defaultAggregateCacheSize = 1024
+const defaultSnapshotThreshold = 100
+
+type cachedAggregate struct {
+	mu sync.RWMutex
+}
+
+type lruEntry struct {
+	stream string
+	agg    *cachedAggregate
+}
+
+// aggregateCache hands out a per-stream RWMutex so unrelated entities
+// don't contend on a single global app lock, evicting the least recently
+// used streams once capacity is reached.
+type aggregateCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newAggregateCache(capacity int) *aggregateCache {
+	return &aggregateCache{capacity: capacity, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *aggregateCache) lockFor(stream string) *cachedAggregate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[stream]; ok {
+		c.ll.MoveToFront(el)
+		return el.Value.(*lruEntry).agg
+	}
+
+	agg := &cachedAggregate{}
+	el := c.ll.PushFront(&lruEntry{stream: stream, agg: agg})
+	c.items[stream] = el
+
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		// Only evict if nobody is currently holding this stream's lock;
+		// otherwise a concurrent caller for the same stream would get a
+		// brand new, independent mutex and bypass the in-flight holder's
+		// exclusion entirely. Leave it in the cache (slightly over
+		// capacity) until it's free to evict.
+		if oldest != nil && oldest.Value.(*lruEntry).agg != agg {
+			oldestAgg := oldest.Value.(*lruEntry).agg
+			if oldestAgg.mu.TryLock() {
+				oldestAgg.mu.Unlock()
+				c.ll.Remove(oldest)
+				delete(c.items, oldest.Value.(*lruEntry).stream)
+			}
+		}
+	}
+
+	return agg
+}
+
+// aggregate loads id's current state for econf. When the store has a
+// snapshot and supports RangeFrom, it only replays the events after the
+// snapshot's version on top of it; otherwise it replays the full stream,
+// same as before Snapshotter existed. It is read-only: it never writes a
+// snapshot itself, since it backs both the pre-write read in HandleEvent
+// and the plain GET path in App.Entity, and a read must not have the side
+// effect of a store write. baseVersion (the version of the snapshot it
+// started from, zero if none) is returned so a caller that goes on to
+// write a new event can decide whether to snapshot again.
+func (app *App) aggregate(econf *EntityConf, id string) (*Entity, uint64, uint64, error) {
+	stream := econf.Name + "-" + id
+
+	var baseline *Entity
+	var baseVersion uint64
+	if snap, ok := app.Store.(Snapshotter); ok {
+		if state, v, err := snap.LoadSnapshot(stream); err == nil {
+			var e Entity
+			if err := json.Unmarshal(state, &e); err == nil {
+				baseline = &e
+				baseVersion = v
+			}
+		}
+	}
+
+	if baseline != nil {
+		if rf, ok := app.Store.(RangeFromer); ok {
+			entity := baseline
+			ch, version := rf.RangeFrom(stream, baseVersion)
+			for ev := range ch {
+				h, has := econf.EventHandlers[ev.GetType()]
+				if !has {
+					continue
+				}
+				if _, err := h.Handle(id, ev, entity); err != nil {
+					return nil, 0, 0, err
+				}
+			}
+			entity.Version = version
+
+			return entity, version, baseVersion, nil
+		}
+	}
+
+	ch, version := app.Store.Range(stream)
+	entity, err := econf.Aggregate(id, ch)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	entity.Version = version
+
+	return entity, version, baseVersion, nil
+}
+
+// maybeSnapshot persists entity's current state once version has moved
+// far enough past the snapshot it was built from. Callers are expected to
+// only invoke this after a successful write, with version already
+// reflecting the event that was just stored - never from a read path.
+func (app *App) maybeSnapshot(snap Snapshotter, stream string, entity *Entity, version, baseVersion uint64) {
+	if version-baseVersion < uint64(app.SnapshotThreshold) {
+		return
+	}
+	entity.Version = version
+	if state, err := json.Marshal(entity); err == nil {
+		snap.SaveSnapshot(stream, version, state)
+	}
+}
+
+// RebuildEntity reconstructs id's current state for name by replaying the
+// full event stream from app.Store, bypassing any cached snapshot
+// entirely, and persists the result as the new snapshot. It exists for
+// operational recovery: unlike aggregate, it never trusts a possibly
+// stale or corrupted snapshot, so it can be used to rebuild past one. It
+// takes the same per-stream lock as HandleEvent and Entity, and keeps
+// holding it through the snapshot write, so a concurrent write (and the
+// snapshot it saves) can't land in the gap and get clobbered by this
+// stale read.
+func (app *App) RebuildEntity(name, id string) (*Entity, uint64, error) {
+	econf, ok := app.Entities[name]
+	if !ok {
+		return nil, 0, InvalidEntityError
+	}
+
+	stream := name + "-" + id
+	cached := app.aggCache.lockFor(stream)
+	cached.mu.RLock()
+	defer cached.mu.RUnlock()
+
+	ch, version := app.Store.Range(stream)
+	entity, err := econf.Aggregate(id, ch)
+	if err != nil {
+		return nil, 0, err
+	}
+	entity.Version = version
+
+	app.persistSnapshot(stream, entity, version)
+
+	return entity, version, nil
+}
+
+// SnapshotEntity reads id's current state for name via the normal
+// snapshot-aware aggregate path (unlike RebuildEntity, it trusts an
+// existing snapshot) and persists that state as the new snapshot. It
+// holds the same per-stream lock across the read and the write for the
+// same reason RebuildEntity does: so a concurrent write's snapshot can't
+// be overwritten by this one's stale read.
+func (app *App) SnapshotEntity(name, id string) (*Entity, uint64, error) {
+	econf, ok := app.Entities[name]
+	if !ok {
+		return nil, 0, InvalidEntityError
+	}
+
+	stream := name + "-" + id
+	cached := app.aggCache.lockFor(stream)
+	cached.mu.RLock()
+	defer cached.mu.RUnlock()
+
+	entity, version, _, err := app.aggregate(econf, id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	app.persistSnapshot(stream, entity, version)
+
+	return entity, version, nil
+}
+
+// persistSnapshot saves entity/version as stream's snapshot, if the
+// underlying store supports it. Errors are swallowed: a failed snapshot
+// write shouldn't fail the request that triggered it, only leave the
+// existing snapshot in place. Callers must already hold stream's lock,
+// so the read this snapshot reflects and the write that saves it happen
+// as one atomic step.
+func (app *App) persistSnapshot(stream string, entity *Entity, version uint64) {
+	snap, ok := app.Store.(Snapshotter)
+	if !ok {
+		return
+	}
+	if state, err := json.Marshal(entity); err == nil {
+		snap.SaveSnapshot(stream, version, state)
+	}
+}
@@ -0,0 +1,43 @@
+package gocqrs
+
+import "testing"
+
+func TestAggregateCache_LockForReturnsSameInstance(t *testing.T) {
+	c := newAggregateCache(4)
+	a := c.lockFor("stream-1")
+	b := c.lockFor("stream-1")
+	if a != b {
+		t.Fatalf("expected repeated lockFor calls for the same stream to return the same lock")
+	}
+}
+
+func TestAggregateCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := newAggregateCache(2)
+	c.lockFor("a")
+	c.lockFor("b")
+	c.lockFor("c") // should evict "a", the least recently used
+
+	if _, ok := c.items["a"]; ok {
+		t.Fatalf("expected stream \"a\" to be evicted")
+	}
+	if _, ok := c.items["b"]; !ok {
+		t.Fatalf("expected stream \"b\" to still be cached")
+	}
+	if _, ok := c.items["c"]; !ok {
+		t.Fatalf("expected stream \"c\" to be cached")
+	}
+}
+
+func TestAggregateCache_DoesNotEvictAHeldLock(t *testing.T) {
+	c := newAggregateCache(2)
+	a := c.lockFor("a")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c.lockFor("b")
+	c.lockFor("c") // "a" is the LRU candidate but is currently held
+
+	if _, ok := c.items["a"]; !ok {
+		t.Fatalf("expected a held lock not to be evicted even when over capacity")
+	}
+}